@@ -18,9 +18,13 @@ package libmqtt
 
 import (
 	"bytes"
+	"context"
+	cryptorand "crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/binary"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"sync"
 	"time"
@@ -43,6 +47,56 @@ type BackoffOption struct {
 	Factor float32
 }
 
+// ConnLostHandler is called whenever a connection to server is lost,
+// whether or not the client will attempt to reconnect.
+type ConnLostHandler func(server string, err error)
+
+// ReconnectHandler is called before each reconnect attempt, after the
+// backoff delay has been computed but before it is waited out.
+type ReconnectHandler func(server string, attempt int, delay time.Duration)
+
+// newJitterSource seeds a *rand.Rand from crypto/rand, falling back to
+// the current time if that fails, so independently-started clients in
+// a fleet don't compute the identical backoff sequence from the
+// default math/rand source's well-known seed.
+func newJitterSource() *rand.Rand {
+	var seed int64
+	if err := binary.Read(cryptorand.Reader, binary.BigEndian, &seed); err != nil {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed))
+}
+
+// nextBackoff computes the next reconnect delay from bf using
+// decorrelated jitter: min(MaxDelay, random_between(FirstDelay, prev*3)).
+// prev should be zero for the first retry. bf.Factor is not used: the
+// delay grows only through the prev*3 upper bound of the jitter range.
+// Safe for concurrent use by the reconnect loops of multiple servers on
+// the same client.
+func (c *client) nextBackoff(prev time.Duration) time.Duration {
+	bf := c.options.bf
+	first := time.Duration(bf.FirstDelay) * time.Second
+	max := time.Duration(bf.MaxDelay) * time.Second
+	if prev <= 0 {
+		return first
+	}
+
+	ceil := prev * 3
+	if ceil <= first {
+		ceil = first + 1
+	}
+
+	c.jitterMu.Lock()
+	r := c.jitterRand.Int63n(int64(ceil - first))
+	c.jitterMu.Unlock()
+
+	next := first + time.Duration(r)
+	if next > max {
+		next = max
+	}
+	return next
+}
+
 // Option is client option for connection options
 type Option func(*client)
 
@@ -82,6 +136,40 @@ func WithBackoffStrategy(bf *BackoffOption) Option {
 	}
 }
 
+// WithAutoReconnect enables or disables automatic reconnection with
+// backoff when a connection is lost, see WithBackoffStrategy
+func WithAutoReconnect(autoReconnect bool) Option {
+	return func(c *client) {
+		c.options.autoReconnect = autoReconnect
+	}
+}
+
+// WithConnLostHandler sets the handler called whenever a connection
+// to server is lost, whether or not the client will reconnect
+func WithConnLostHandler(h ConnLostHandler) Option {
+	return func(c *client) {
+		c.options.connLostHandler = h
+	}
+}
+
+// WithReconnectHandler sets the handler called before each reconnect
+// attempt, once the backoff delay for that attempt has been decided
+func WithReconnectHandler(h ReconnectHandler) Option {
+	return func(c *client) {
+		c.options.reconnectHandler = h
+	}
+}
+
+// WithShutdownTimeout bounds how long Disconnect (and a non-forced
+// Destroy) will wait for each connection's queued sends to drain and
+// its DISCONNECT to go out before giving up and closing the socket
+// anyway. Defaults to 5 seconds.
+func WithShutdownTimeout(timeout time.Duration) Option {
+	return func(c *client) {
+		c.options.shutdownTimeout = timeout
+	}
+}
+
 // WithClientId set the client id for connection
 func WithClientId(clientId string) Option {
 	return func(c *client) {
@@ -101,8 +189,13 @@ func WithWill(topic string, qos QosLevel, retain bool, payload []byte) Option {
 }
 
 // WithServer adds servers as client server
-// Just use "ip:port" or "domain.name:port"
-// Only TCP connection supported for now
+// Use "ip:port" or "domain.name:port" for a plain TCP connection, or
+// prefix with a scheme to pick a different transport: "tcp://",
+// "tls://", "ws://", "wss://" or "unix://". A bare address and an
+// explicit "tcp://" still honor WithTLS when set, same as before
+// WithServer grew scheme support. The scheme is ignored when WithDialer
+// installs a custom Dialer, which then handles every server regardless
+// of scheme.
 func WithServer(servers ...string) Option {
 	return func(c *client) {
 		c.options.servers = servers
@@ -194,23 +287,37 @@ func NewClient(options ...Option) Client {
 
 // clientOptions is the options for client to connect, reconnect, disconnect
 type clientOptions struct {
-	sendChanSize    int            // send channel size
-	recvChanSize    int            // recv channel size
-	servers         []string       // server address strings
-	dialTimeout     time.Duration  // dial timeout in second
-	clientId        string         // used by ConPacket
-	username        string         // used by ConPacket
-	password        string         // used by ConPacket
-	keepalive       time.Duration  // used by ConPacket (time in second)
-	keepaliveFactor float64        // used for reasonable amount time to close conn if no ping resp
-	cleanSession    bool           // used by ConPacket
-	isWill          bool           // used by ConPacket
-	willTopic       string         // used by ConPacket
-	willPayload     []byte         // used by ConPacket
-	willQos         byte           // used by ConPacket
-	willRetain      bool           // used by ConPacket
-	tlsConfig       *tls.Config    // tls config with client side cert
-	bf              *BackoffOption // backoff option for client reconnection
+	sendChanSize     int              // send channel size
+	recvChanSize     int              // recv channel size
+	servers          []string         // server address strings
+	dialTimeout      time.Duration    // dial timeout in second
+	clientId         string           // used by ConPacket
+	username         string           // used by ConPacket
+	password         string           // used by ConPacket
+	keepalive        time.Duration    // used by ConPacket (time in second)
+	keepaliveFactor  float64          // used for reasonable amount time to close conn if no ping resp
+	cleanSession     bool             // used by ConPacket
+	isWill           bool             // used by ConPacket
+	willTopic        string           // used by ConPacket
+	willPayload      []byte           // used by ConPacket
+	willQos          byte             // used by ConPacket
+	willRetain       bool             // used by ConPacket
+	tlsConfig        *tls.Config      // tls config with client side cert
+	store            Store            // persists in-flight QoS1/2 publishes and inbound QoS2 release state
+	dialer           Dialer           // overrides scheme-based dialer selection for every server, see WithDialer
+	bf               *BackoffOption   // backoff option for client reconnection
+	autoReconnect    bool             // whether to reconnect (with backoff) after a connection is lost
+	connLostHandler  ConnLostHandler  // called whenever a connection to server is lost
+	reconnectHandler ReconnectHandler // called before each reconnect attempt
+	shutdownTimeout  time.Duration    // how long Disconnect waits for a graceful drain, see WithShutdownTimeout
+
+	protocolVersion   ProtocolVersion   // MQTT protocol revision to speak, defaults to V311
+	sessionExpiry     time.Duration     // v5 CONNECT SessionExpiryInterval
+	receiveMaximum    uint16            // v5 CONNECT ReceiveMaximum
+	topicAliasMax     uint16            // v5 CONNECT TopicAliasMaximum, also enables outgoing alias compression
+	willDelay         time.Duration     // v5 CONNECT will delay
+	disconnHandler    DisconnHandler    // called when the broker sends a DISCONNECT
+	assignedIdHandler AssignedIdHandler // called when the broker assigns a ClientID
 }
 
 // Client act as a mqtt client
@@ -218,19 +325,50 @@ type Client interface {
 	// Connect to all specified server with client options
 	Connect(h ConnHandler)
 
+	// ConnectCtx is the context-aware variant of Connect.
+	// Canceling ctx aborts any connection attempt still in flight and
+	// stops the packet dispatcher started for this client.
+	ConnectCtx(ctx context.Context, h ConnHandler)
+
 	// Publish a message for the topic
 	Publish(h PubHandler, msg ...*PublishPacket)
 
+	// PublishCtx is the context-aware variant of Publish.
+	// Canceling ctx aborts queuing of the not-yet-sent messages.
+	PublishCtx(ctx context.Context, h PubHandler, msg ...*PublishPacket)
+
 	// Subscribe topic(s)
 	Subscribe(h SubHandler, topics ...*Topic)
 
+	// SubscribeCtx is the context-aware variant of Subscribe.
+	SubscribeCtx(ctx context.Context, h SubHandler, topics ...*Topic)
+
 	// UnSubscribe topic(s)
 	UnSubscribe(h UnSubHandler, topics ...string)
 
+	// UnSubscribeCtx is the context-aware variant of UnSubscribe.
+	UnSubscribeCtx(ctx context.Context, h UnSubHandler, topics ...string)
+
 	// Wait will wait until all connection finished
 	Wait()
 
-	// Destroy all client connection
+	// WaitCtx is the context-aware variant of Wait.
+	// It returns early with ctx.Err() if ctx is canceled before every
+	// connection has finished.
+	WaitCtx(ctx context.Context) error
+
+	// Disconnect gracefully shuts every connection down: no further
+	// Publish/Subscribe/UnSubscribe is accepted, each connection drains
+	// its queued sends (or stops waiting once ctx is done or
+	// WithShutdownTimeout elapses, whichever comes first), sends a
+	// DISCONNECT, then closes its socket. Returns ctx's error, if any,
+	// or context.DeadlineExceeded if WithShutdownTimeout elapsed first.
+	Disconnect(ctx context.Context) error
+
+	// Destroy all client connection.
+	// If force is true, connections are closed immediately without
+	// draining queued sends or sending a DISCONNECT; otherwise Destroy
+	// behaves like Disconnect(context.Background()).
 	Destroy(force bool)
 }
 
@@ -239,9 +377,35 @@ type client struct {
 	router  TopicRouter        // topic router
 	sendC   chan Packet        // Pub channel for sending publish packet to server
 	recvC   chan PublishPacket // Pub recv channel for receiving
-	subs    *sync.Map          // Topic(s) -> []SubHandler
+	subs    *sync.Map          // topic name -> *Topic, used to resubscribe after reconnect
 	conn    *sync.Map          // ServerAddr -> connection
 	idGen   *idGenerator       // sorted in use packetId []uint16
+	ctx     context.Context    // root context for this client, canceled by Destroy/Disconnect
+	cancel  context.CancelFunc // cancels ctx
+
+	jitterRand *rand.Rand // per-client source for nextBackoff, see newJitterSource
+	jitterMu   sync.Mutex // guards jitterRand, which is not safe for concurrent use
+
+	sendOnce  sync.Once     // starts dispatchSend at most once, on the first ConnectCtx
+	closing   chan struct{} // closed once Destroy/Disconnect starts, rejects new Publish/Subscribe/UnSubscribe
+	closeOnce sync.Once     // closes closing at most once
+
+	pendingSub   *sync.Map // packetId -> subAckWaiter, awaiting SUBACK
+	pendingUnsub *sync.Map // packetId -> unsubAckWaiter, awaiting UNSUBACK
+	pendingPub   *sync.Map // packetId -> PubHandler, awaiting PUBACK/PUBCOMP
+}
+
+// subAckWaiter remembers which topics a SUBSCRIBE covered so the
+// per-topic SUBACK reason codes can be reported back through h.
+type subAckWaiter struct {
+	handler SubHandler
+	topics  []*Topic
+}
+
+// unsubAckWaiter is the UNSUBSCRIBE counterpart of subAckWaiter.
+type unsubAckWaiter struct {
+	handler UnSubHandler
+	topics  []string
 }
 
 // defaultClient create the client with default options
@@ -258,30 +422,68 @@ func defaultClient() *client {
 			dialTimeout:     20 * time.Second, // default timeout when dial to server
 			keepalive:       2 * time.Minute,  // default keepalive interval is 2min
 			keepaliveFactor: 1.5,              // default reasonable amount of time 3min
+			store:           newMemStore(),    // default store keeps in-flight state in-process only
 		},
-		router: &TextRouter{}, // default router is REST style router
-		subs:   &sync.Map{},
-		conn:   &sync.Map{},
-		idGen:  newIdGenerator(),
+		router:     &TextRouter{}, // default router is REST style router
+		subs:       &sync.Map{},
+		conn:       &sync.Map{},
+		idGen:      newIdGenerator(),
+		jitterRand: newJitterSource(),
+		closing:    make(chan struct{}),
+
+		pendingSub:   &sync.Map{},
+		pendingUnsub: &sync.Map{},
+		pendingPub:   &sync.Map{},
 	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
 	return c
 }
 
 // Connect to all designated server
 func (c *client) Connect(h ConnHandler) {
+	c.ConnectCtx(context.Background(), h)
+}
+
+// ConnectCtx to all designated server, canceling ctx tears down the
+// in-flight connection attempts and stops the packet dispatcher
+func (c *client) ConnectCtx(ctx context.Context, h ConnHandler) {
+	c.sendOnce.Do(func() { go c.dispatchSend() })
+
 	for _, s := range c.options.servers {
-		go c.connect(s, h)
+		go c.connect(ctx, s, h)
 	}
 	go func() {
-		for pkt := range c.recvC {
-			c.router.Dispatch(pkt)
+		for {
+			select {
+			case pkt, more := <-c.recvC:
+				if !more {
+					return
+				}
+				c.router.Dispatch(pkt)
+			case <-ctx.Done():
+				return
+			case <-c.ctx.Done():
+				return
+			}
 		}
 	}()
 }
 
 // Publish message(s) to topic(s), one to one
 func (c *client) Publish(h PubHandler, msg ...*PublishPacket) {
+	c.PublishCtx(context.Background(), h, msg...)
+}
+
+// PublishCtx is the context-aware variant of Publish
+func (c *client) PublishCtx(ctx context.Context, h PubHandler, msg ...*PublishPacket) {
 	for _, m := range msg {
+		// checked up front, since the select below may otherwise pick a
+		// ready sendC over an already closed closing
+		select {
+		case <-c.closing:
+			return
+		default:
+		}
 		if m.Qos > Qos2 {
 			panic("invalid QoS level, should either be 0, 1 or 2 ")
 		}
@@ -293,25 +495,85 @@ func (c *client) Publish(h PubHandler, msg ...*PublishPacket) {
 		}
 		if toSend.Qos != Qos0 {
 			toSend.PacketId = c.nextId()
+			if err := c.options.store.PutOutbound(toSend.PacketId, toSend); err != nil {
+				lg.e("STORE PutOutbound failed, id =", toSend.PacketId, "err =", err)
+			}
+			if h != nil {
+				c.pendingPub.Store(toSend.PacketId, h)
+			}
 		}
 
-		c.sendC <- toSend
+		select {
+		case c.sendC <- toSend:
+		case <-ctx.Done():
+			c.abortPublish(toSend, h)
+			return
+		case <-c.ctx.Done():
+			c.abortPublish(toSend, h)
+			return
+		case <-c.closing:
+			c.abortPublish(toSend, h)
+			return
+		}
 	}
 }
 
+// abortPublish undoes the bookkeeping PublishCtx did for toSend before
+// giving up on queuing it, so a cancelled Publish doesn't permanently
+// burn a packet id or leave an orphaned Store/pendingPub entry that
+// was never actually put on the wire.
+func (c *client) abortPublish(toSend *PublishPacket, h PubHandler) {
+	if toSend.Qos == Qos0 {
+		return
+	}
+	if h != nil {
+		c.pendingPub.Delete(toSend.PacketId)
+	}
+	if err := c.options.store.DeleteOutbound(toSend.PacketId); err != nil {
+		lg.e("STORE DeleteOutbound failed, id =", toSend.PacketId, "err =", err)
+	}
+	c.freeId(toSend.PacketId)
+}
+
 // SubScribe topic(s)
 func (c *client) Subscribe(h SubHandler, topics ...*Topic) {
+	c.SubscribeCtx(context.Background(), h, topics...)
+}
+
+// SubscribeCtx is the context-aware variant of Subscribe
+func (c *client) SubscribeCtx(ctx context.Context, h SubHandler, topics ...*Topic) {
+	select {
+	case <-c.closing:
+		return
+	default:
+	}
 	if h != nil {
 		for _, t := range topics {
 			c.router.Handle(t.Name, h)
 		}
 	}
+	for _, t := range topics {
+		c.subs.Store(t.Name, t)
+	}
 
 	// send sub message
 	lg.d("SEND Subscribe, topic(s) =", topics)
-	c.sendC <- &SubscribePacket{
+	id := c.nextId()
+	c.pendingSub.Store(id, subAckWaiter{handler: h, topics: topics})
+	select {
+	case c.sendC <- &SubscribePacket{
 		Topics:   topics,
-		PacketId: c.nextId(),
+		PacketId: id,
+	}:
+	case <-ctx.Done():
+		c.pendingSub.Delete(id)
+		c.freeId(id)
+	case <-c.ctx.Done():
+		c.pendingSub.Delete(id)
+		c.freeId(id)
+	case <-c.closing:
+		c.pendingSub.Delete(id)
+		c.freeId(id)
 	}
 }
 
@@ -322,21 +584,49 @@ func (c *client) Handle(topic string, h SubHandler) {
 
 // UnSubscribe topic(s)
 func (c *client) UnSubscribe(h UnSubHandler, topics ...string) {
+	c.UnSubscribeCtx(context.Background(), h, topics...)
+}
+
+// UnSubscribeCtx is the context-aware variant of UnSubscribe
+func (c *client) UnSubscribeCtx(ctx context.Context, h UnSubHandler, topics ...string) {
+	select {
+	case <-c.closing:
+		return
+	default:
+	}
 	for _, t := range topics {
 		c.subs.Delete(t)
 	}
 
 	lg.d("SEND UnSub, topic(s) =", topics)
-	c.sendC <- &UnSubPacket{
+	id := c.nextId()
+	c.pendingUnsub.Store(id, unsubAckWaiter{handler: h, topics: topics})
+	select {
+	case c.sendC <- &UnSubPacket{
 		TopicNames: topics,
-		PacketId:   c.nextId(),
+		PacketId:   id,
+	}:
+	case <-ctx.Done():
+		c.pendingUnsub.Delete(id)
+		c.freeId(id)
+	case <-c.ctx.Done():
+		c.pendingUnsub.Delete(id)
+		c.freeId(id)
+	case <-c.closing:
+		c.pendingUnsub.Delete(id)
+		c.freeId(id)
 	}
-
 }
 
 // Wait will wait for all connection to exit
 // Once called Connect(), you should never add any server to this client
 func (c *client) Wait() {
+	c.WaitCtx(context.Background())
+}
+
+// WaitCtx is the context-aware variant of Wait, returning ctx.Err()
+// if ctx is canceled before every connection has finished
+func (c *client) WaitCtx(ctx context.Context) error {
 	wg := &sync.WaitGroup{}
 	connSet := make([]*connImpl, 0)
 	c.conn.Range(func(k, v interface{}) bool {
@@ -352,53 +642,160 @@ func (c *client) Wait() {
 			wg.Done()
 		}()
 	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
 	lg.d("client waiting")
-	wg.Wait()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Destroy will disconnect form all server
 // If force is true, then close connection without sending a DisConnPacket
 func (c *client) Destroy(force bool) {
-	close(c.recvC)
+	if force {
+		c.closeOnce.Do(func() { close(c.closing) })
+		c.cancel()
+		c.conn.Range(func(k, v interface{}) bool {
+			v.(*connImpl).close(true)
+			return true
+		})
+		return
+	}
+
+	c.Disconnect(context.Background())
+}
+
+// Disconnect gracefully shuts every connection down: Destroy(false) is
+// equivalent to Disconnect(context.Background()). New Publish/
+// Subscribe/UnSubscribe calls are rejected first, then each connection
+// is given until ctx is done or WithShutdownTimeout elapses (5s by
+// default) to drain its queued sends and send a DISCONNECT, after
+// which its socket is closed regardless.
+func (c *client) Disconnect(ctx context.Context) error {
+	c.closeOnce.Do(func() { close(c.closing) })
+
+	timeout := c.options.shutdownTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	drainCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	wg := &sync.WaitGroup{}
 	c.conn.Range(func(k, v interface{}) bool {
-		va := v.(*connImpl)
-		va.close(force)
+		conn := v.(*connImpl)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn.disconnect(drainCtx)
+		}()
 		return true
 	})
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-drainCtx.Done():
+	}
+
+	c.cancel()
+	return drainCtx.Err()
 }
 
-// connect to one server and start mqtt logic
-func (c *client) connect(server string, h ConnHandler) {
-	var conn net.Conn
-	var err error
+// connect to one server and start mqtt logic, reconnecting with backoff
+// (per WithBackoffStrategy) while WithAutoReconnect is enabled
+func (c *client) connect(ctx context.Context, server string, h ConnHandler) {
+	var prevDelay time.Duration
+	attempt := 0
 
-	if c.options.tlsConfig != nil {
-		// with tls
-		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: c.options.dialTimeout}, "tcp", server, c.options.tlsConfig)
-		if err != nil {
-			lg.e("connection with tls failed", err)
-			h(server, 0, err)
+	for {
+		err := c.connectOnce(ctx, server, h, attempt > 0)
+		if ctx.Err() != nil || c.ctx.Err() != nil {
 			return
 		}
-	} else {
-		// without tls
-		conn, err = net.DialTimeout("tcp", server, c.options.dialTimeout)
-		if err != nil {
-			lg.e("connection failed", err)
-			h(server, 0, err)
+
+		if c.options.connLostHandler != nil {
+			c.options.connLostHandler(server, err)
+		}
+
+		if re, ok := err.(*ReasonError); ok && re.Code == ReasonSessionTakenOver {
+			// another client has taken over this ClientID's session;
+			// reconnecting with the same ClientID would just re-trigger
+			// takeover on whoever now holds it, flip-flopping forever, so
+			// surface this via disconnHandler/connLostHandler instead of
+			// feeding it through the generic backoff-and-retry path
+			return
+		}
+
+		if !c.options.autoReconnect {
+			return
+		}
+
+		attempt++
+		prevDelay = c.nextBackoff(prevDelay)
+		if c.options.reconnectHandler != nil {
+			c.options.reconnectHandler(server, attempt, prevDelay)
+		}
+
+		select {
+		case <-time.After(prevDelay):
+		case <-ctx.Done():
+			return
+		case <-c.ctx.Done():
 			return
 		}
 	}
+}
 
+// connectOnce dials server, performs the MQTT handshake and runs the
+// connection until it is lost or ctx is canceled. isReconnect controls
+// whether subscriptions are restored once the handshake succeeds;
+// in-flight publishes persisted in the Store are resent after every
+// successful handshake, see resendPending.
+func (c *client) connectOnce(ctx context.Context, server string, h ConnHandler, isReconnect bool) error {
+	conn, err := c.dial(ctx, server)
+	if err != nil {
+		lg.e("connection failed", err)
+		h(server, 0, err)
+		return err
+	}
+
+	connCtx, cancel := context.WithCancel(ctx)
+	// however connectOnce returns below, make sure this connImpl's
+	// handleSend/keepalive goroutines are told to stop; close()/
+	// disconnect() also cancel connCtx, so this is a no-op on those paths
+	defer cancel()
 	connImpl := &connImpl{
 		parent:     c,
+		ctx:        connCtx,
+		cancel:     cancel,
 		name:       server,
 		conn:       conn,
 		sendBuf:    &bytes.Buffer{},
+		sendC:      make(chan Packet, c.options.sendChanSize),
+		sendDone:   make(chan struct{}),
 		keepaliveC: make(chan interface{}),
 		recvC:      make(chan Packet),
 		workers:    &sync.WaitGroup{},
 	}
+	if c.options.protocolVersion == V5 && c.options.topicAliasMax > 0 {
+		connImpl.outAlias = newTopicAlias(c.options.topicAliasMax)
+		connImpl.inAlias = newTopicAlias(c.options.topicAliasMax)
+	}
 
 	connImpl.workers.Add(2)
 	// send
@@ -413,45 +810,196 @@ func (c *client) connect(server string, h ConnHandler) {
 		connImpl.workers.Done()
 	}()
 
-	connImpl.send(&ConPacket{
-		Username:     c.options.username,
-		Password:     c.options.password,
-		ClientId:     c.options.clientId,
-		CleanSession: c.options.cleanSession,
-		IsWill:       c.options.isWill,
-		WillQos:      c.options.willQos,
-		WillTopic:    c.options.willTopic,
-		WillMessage:  c.options.willPayload,
-		WillRetain:   c.options.willRetain,
-		Keepalive:    uint16(c.options.keepalive / time.Second),
-	})
+	if c.options.protocolVersion == V5 {
+		connImpl.send(c.connPacketV5())
+	} else {
+		connImpl.send(&ConPacket{
+			Username:     c.options.username,
+			Password:     c.options.password,
+			ClientId:     c.options.clientId,
+			CleanSession: c.options.cleanSession,
+			IsWill:       c.options.isWill,
+			WillQos:      c.options.willQos,
+			WillTopic:    c.options.willTopic,
+			WillMessage:  c.options.willPayload,
+			WillRetain:   c.options.willRetain,
+			Keepalive:    uint16(c.options.keepalive / time.Second),
+		})
+	}
 
 	select {
 	case pkt, more := <-connImpl.recvC:
 		if more {
 			if pkt.Type() == CtrlConnAck {
-				p := pkt.(*ConAckPacket)
-				if p.Code != ConnAccepted {
-					h(server, p.Code, nil)
-					return
+				if c.options.protocolVersion == V5 {
+					p := pkt.(*ConAckPacketV5)
+					if p.Code != ConnAccepted {
+						h(server, p.Code, nil)
+						return ErrBadPacket
+					}
+					if p.AssignedClientId != "" && c.options.assignedIdHandler != nil {
+						c.options.assignedIdHandler(server, p.AssignedClientId)
+					}
+				} else {
+					p := pkt.(*ConAckPacket)
+					if p.Code != ConnAccepted {
+						h(server, p.Code, nil)
+						return ErrBadPacket
+					}
 				}
 			} else {
 				h(server, 0, ErrBadPacket)
-				return
+				return ErrBadPacket
 			}
 		} else {
 			h(server, 0, ErrBadPacket)
-			return
+			return ErrBadPacket
 		}
 	case <-time.After(c.options.dialTimeout):
 		h(server, 0, ErrTimeOut)
-		return
+		return ErrTimeOut
+	case <-ctx.Done():
+		h(server, 0, ctx.Err())
+		return ctx.Err()
+	case <-c.ctx.Done():
+		h(server, 0, c.ctx.Err())
+		return c.ctx.Err()
 	}
 
 	// login success
 	// start mqtt logic
 	c.conn.Store(server, connImpl)
-	connImpl.start()
+	h(server, 0, nil)
+
+	if isReconnect {
+		c.resubscribe(connImpl)
+	}
+	c.resendPending(connImpl)
+
+	err = connImpl.start()
+	// routeSend must not keep handing packets to this now-dead
+	// connection while connect() is backing off before its next attempt
+	c.conn.Delete(server)
+	return err
+}
+
+// resubscribe re-sends a SUBSCRIBE for every topic currently tracked
+// in c.subs, once a reconnect handshake has succeeded.
+func (c *client) resubscribe(connImpl *connImpl) {
+	topics := make([]*Topic, 0)
+	c.subs.Range(func(k, v interface{}) bool {
+		topics = append(topics, v.(*Topic))
+		return true
+	})
+	if len(topics) > 0 {
+		lg.d("RESUB topic(s) after reconnect =", topics)
+		connImpl.send(&SubscribePacket{
+			Topics:   topics,
+			PacketId: c.nextId(),
+		})
+	}
+}
+
+// resendPending resends, with DUP set, every outstanding QoS1/2
+// publish persisted in c.options.store. Runs on every (re)connect so a
+// durable Store (e.g. NewFileStore) can recover publishes that were
+// queued by a now-dead process.
+func (c *client) resendPending(connImpl *connImpl) {
+	pending, err := c.options.store.AllOutbound()
+	if err != nil {
+		lg.e("STORE AllOutbound failed, err =", err)
+		return
+	}
+
+	for _, p := range pending {
+		pkt := p.(*PublishPacket)
+		lg.d("RESEND Publish after (re)connect, id =", pkt.PacketId)
+		connImpl.send(&PublishPacket{
+			Qos:       pkt.Qos,
+			IsRetain:  pkt.IsRetain,
+			IsDup:     true,
+			TopicName: pkt.TopicName,
+			Payload:   pkt.Payload,
+			PacketId:  pkt.PacketId,
+		})
+	}
+}
+
+// dial opens a connection to server, honoring ctx cancellation and the
+// client's tls config
+func (c *client) dial(ctx context.Context, server string) (net.Conn, error) {
+	dialer, addr, err := c.resolveDialer(server)
+	if err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+
+	resC := make(chan result, 1)
+	go func() {
+		conn, err := dialer.Dial(ctx, addr)
+		resC <- result{conn, err}
+	}()
+
+	select {
+	case r := <-resC:
+		return r.conn, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// dispatchSend fans packets queued on the client-level sendC out to
+// one live connection's own send queue, so a connection that breaks
+// out of its handleSend loop can no longer steal packets queued for
+// another connection. Started at most once, by the first ConnectCtx.
+func (c *client) dispatchSend() {
+	for {
+		select {
+		case pkt, more := <-c.sendC:
+			if !more {
+				return
+			}
+			c.routeSend(pkt)
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// routeSend delivers pkt to the send queue of any one currently
+// connected connImpl, waiting for a (re)connect if none is live yet,
+// and retrying against another connection if the chosen one tears
+// down before it can accept pkt.
+func (c *client) routeSend(pkt Packet) {
+	for {
+		var target *connImpl
+		c.conn.Range(func(k, v interface{}) bool {
+			target = v.(*connImpl)
+			return false
+		})
+
+		if target == nil || target.ctx.Err() != nil {
+			select {
+			case <-time.After(10 * time.Millisecond):
+				continue
+			case <-c.ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case target.sendC <- pkt:
+			return
+		case <-target.ctx.Done():
+			continue
+		case <-c.ctx.Done():
+			return
+		}
+	}
 }
 
 // get next valid packet id
@@ -467,18 +1015,53 @@ func (c *client) freeId(id uint16) {
 // connImpl is the wrapper of connection to server
 // tend to actual packet send and receive
 type connImpl struct {
-	parent     *client          // client which created this connection
-	name       string           // server addr info
-	conn       net.Conn         // connection to server
-	sendBuf    *bytes.Buffer    // buffer for packet send
-	recvC      chan Packet      // received packet from server
-	keepaliveC chan interface{} // keepalive packet
-	packetId   *sync.Map        // used pktId (key: packetId, value: packet)
-	workers    *sync.WaitGroup  // mqtt logic processor
+	parent     *client            // client which created this connection
+	ctx        context.Context    // per-connection context, derived from the ctx passed to connect
+	cancel     context.CancelFunc // cancels ctx, invoked from close()
+	name       string             // server addr info
+	conn       net.Conn           // connection to server
+	sendBuf    *bytes.Buffer      // buffer for packet send
+	sendC      chan Packet        // this connection's own outbound queue, fed by the client's fan-out
+	sendDone   chan struct{}      // closed once handleSend returns
+	recvC      chan Packet        // received packet from server
+	keepaliveC chan interface{}   // keepalive packet
+	packetId   *sync.Map          // used pktId (key: packetId, value: packet)
+	workers    *sync.WaitGroup    // mqtt logic processor
+	outAlias   *topicAlias        // outgoing topic alias mapping (v5 only, nil otherwise)
+	inAlias    *topicAlias        // incoming topic alias mapping (v5 only, nil otherwise)
+}
+
+// notifyPubAck looks up and clears the PubHandler registered for id by
+// Publish/PublishCtx, if any, and reports code through it.
+func (c *connImpl) notifyPubAck(id uint16, code byte) {
+	v, ok := c.parent.pendingPub.Load(id)
+	if !ok {
+		return
+	}
+	c.parent.pendingPub.Delete(id)
+
+	h := v.(PubHandler)
+	if h == nil {
+		return
+	}
+
+	topic := ""
+	if pkt, ok, _ := c.parent.options.store.GetOutbound(id); ok {
+		topic = pkt.(*PublishPacket).TopicName
+	}
+	h(topic, reasonErr(code))
+}
+
+// deleteOutbound removes the persisted outbound publish for id from
+// the client's Store, once it has been fully acknowledged.
+func (c *connImpl) deleteOutbound(id uint16) {
+	if err := c.parent.options.store.DeleteOutbound(id); err != nil {
+		lg.e("STORE DeleteOutbound failed, id =", id, "err =", err)
+	}
 }
 
 // start mqtt logic
-func (c *connImpl) start() {
+func (c *connImpl) start() error {
 	// start keepalive if required
 	if c.parent.options.keepalive > 0 {
 		c.workers.Add(1)
@@ -489,21 +1072,62 @@ func (c *connImpl) start() {
 	}
 
 	// inspect incoming packet
-	for pkt := range c.recvC {
+	for {
+		var pkt Packet
+		var more bool
+		select {
+		case pkt, more = <-c.recvC:
+			if !more {
+				return ErrConnLost
+			}
+		case <-c.ctx.Done():
+			return nil
+		}
+
 		switch pkt.Type() {
 		case CtrlSubAck:
 			p := pkt.(*SubAckPacket)
 			lg.d("RECV SubAck, id =", p.PacketId)
+			if v, ok := c.parent.pendingSub.Load(p.PacketId); ok {
+				c.parent.pendingSub.Delete(p.PacketId)
+				w := v.(subAckWaiter)
+				if w.handler != nil {
+					for i, t := range w.topics {
+						var code byte
+						if i < len(p.ReasonCodes) {
+							code = p.ReasonCodes[i]
+						}
+						w.handler(t.Name, reasonErr(code))
+					}
+				}
+			}
 			c.parent.freeId(p.PacketId)
-			// TODO: notify Sub QoS response
 		case CtrlUnSubAck:
 			p := pkt.(*UnSubAckPacket)
 			lg.d("RECV UnSubAck, id =", p.PacketId)
+			if v, ok := c.parent.pendingUnsub.Load(p.PacketId); ok {
+				c.parent.pendingUnsub.Delete(p.PacketId)
+				w := v.(unsubAckWaiter)
+				if w.handler != nil {
+					for i, name := range w.topics {
+						var code byte
+						if i < len(p.ReasonCodes) {
+							code = p.ReasonCodes[i]
+						}
+						w.handler(name, reasonErr(code))
+					}
+				}
+			}
 			c.parent.freeId(p.PacketId)
 		case CtrlPublish:
 			p := pkt.(*PublishPacket)
+			c.inAlias.resolveInbound(p)
 			lg.d("RECV Publish, id =", p.PacketId, "QoS =", p.Qos)
-			c.parent.recvC <- *p
+			select {
+			case c.parent.recvC <- *p:
+			case <-c.ctx.Done():
+				return nil
+			}
 			lg.i("PUB Publish to client, topic =", p.TopicName)
 
 			// tend to QoS issue
@@ -519,24 +1143,49 @@ func (c *connImpl) start() {
 			p := pkt.(*PubAckPacket)
 			lg.d("RECV PubAck, id =", p.PacketId)
 
+			c.notifyPubAck(p.PacketId, p.ReasonCode)
+			c.deleteOutbound(p.PacketId)
 			c.parent.freeId(p.PacketId)
 		case CtrlPubRecv:
 			p := pkt.(*PubRecvPacket)
 			lg.d("RECV PubRec, id =", p.PacketId)
 
+			if err := reasonErr(p.ReasonCode); err != nil {
+				c.notifyPubAck(p.PacketId, p.ReasonCode)
+				c.deleteOutbound(p.PacketId)
+				c.parent.freeId(p.PacketId)
+				break
+			}
+
 			c.send(&PubRelPacket{PacketId: p.PacketId})
 			lg.d("SEND PubRel, id =", p.PacketId)
 		case CtrlPubRel:
 			p := pkt.(*PubRelPacket)
 			lg.d("RECV PubRel, id =", p.PacketId)
 
+			if err := c.parent.options.store.PutInboundRelease(p.PacketId); err != nil {
+				lg.e("STORE PutInboundRelease failed, id =", p.PacketId, "err =", err)
+			}
+
 			c.send(&PubCompPacket{PacketId: p.PacketId})
 			lg.d("SEND PubComp, id =", p.PacketId)
 		case CtrlPubComp:
 			p := pkt.(*PubCompPacket)
 			lg.d("RECV PubComp id =", p.PacketId)
 
+			c.notifyPubAck(p.PacketId, p.ReasonCode)
+			c.deleteOutbound(p.PacketId)
 			c.parent.freeId(p.PacketId)
+		case CtrlDisConn:
+			p := pkt.(*DisconnectPacketV5)
+			lg.d("RECV Disconnect, reason =", p.ReasonCode)
+			if c.parent.options.disconnHandler != nil {
+				c.parent.options.disconnHandler(c.name, p.ReasonCode, p.Properties)
+			}
+			if p.ReasonCode == ReasonSessionTakenOver {
+				return &ReasonError{Code: p.ReasonCode}
+			}
+			return ErrConnLost
 		default:
 			lg.d("RECV packet, type =", pkt.Type())
 		}
@@ -551,7 +1200,13 @@ func (c *connImpl) keepalive() {
 	t := time.NewTicker(c.parent.options.keepalive)
 	defer t.Stop()
 
-	for range t.C {
+	for {
+		select {
+		case <-t.C:
+		case <-c.ctx.Done():
+			return
+		}
+
 		c.send(PingReqPacket)
 
 		select {
@@ -564,28 +1219,77 @@ func (c *connImpl) keepalive() {
 			t.Stop()
 			c.conn.Close()
 			return
+		case <-c.ctx.Done():
+			return
 		}
 	}
 }
 
-// close this connection
+// close this connection immediately, without draining queued sends or
+// sending a DISCONNECT. Safe to call concurrently with handleSend/
+// handleRecv, which only ever exit, never panic, once ctx is canceled.
 func (c *connImpl) close(force bool) {
 	lg.v(c.name, "close(", force, ")")
+	c.cancel()
+	c.conn.Close()
+}
+
+// disconnect gracefully shuts this connection down: it queues a
+// DISCONNECT behind whatever is already pending in sendC, waits for
+// handleSend to drain and send it (or ctx to be done, whichever comes
+// first), then closes the socket and waits for every worker goroutine
+// (handleSend, handleRecv, keepalive) to exit.
+func (c *connImpl) disconnect(ctx context.Context) {
+	lg.v(c.name, "disconnect()")
+
+	var disconn Packet
+	if c.parent.options.protocolVersion == V5 {
+		disconn = &DisconnectPacketV5{ReasonCode: ReasonNormalDisconnection}
+	} else {
+		disconn = DisConnPacket
+	}
+	c.send(disconn)
+
+	select {
+	case <-c.sendDone:
+	case <-ctx.Done():
+	}
+
+	c.cancel()
 	c.conn.Close()
+	c.wait()
 }
 
 // handle client message send
 func (c *connImpl) handleSend() {
-	for pkt := range c.parent.sendC {
-		pkt.Bytes(c.sendBuf)
-		if _, err := c.sendBuf.WriteTo(c.conn); err != nil {
-			// raise error
-			break
-		}
+	defer close(c.sendDone)
+
+	for {
+		select {
+		case pkt, more := <-c.sendC:
+			if !more {
+				return
+			}
 
-		if pkt.Type() == CtrlDisConn {
-			// disconnect to server
-			break
+			toSend := pkt
+			if pp, ok := pkt.(*PublishPacket); ok && c.outAlias != nil {
+				aliased := *pp
+				c.outAlias.applyOutbound(&aliased)
+				toSend = &aliased
+			}
+
+			toSend.Bytes(c.sendBuf)
+			if _, err := c.sendBuf.WriteTo(c.conn); err != nil {
+				// raise error
+				return
+			}
+
+			if pkt.Type() == CtrlDisConn {
+				// disconnect to server
+				return
+			}
+		case <-c.ctx.Done():
+			return
 		}
 	}
 }
@@ -596,24 +1300,38 @@ func (c *connImpl) handleRecv() {
 		pkt, err := decodeOnePacket(c.conn)
 		if err != nil {
 			lg.e("CONN broken", "server =", c.name, "err =", err)
+			c.conn.Close()
 			close(c.recvC)
 			close(c.keepaliveC)
-			break
+			return
 		}
 
 		// pass packets
 		if pkt == PingRespPacket {
 			lg.d("RECV keepalive message")
-			c.keepaliveC <- nil
+			select {
+			case c.keepaliveC <- nil:
+			case <-c.ctx.Done():
+				return
+			}
 		} else {
-			c.recvC <- pkt
+			select {
+			case c.recvC <- pkt:
+			case <-c.ctx.Done():
+				return
+			}
 		}
 	}
 }
 
-// send internal mqtt logic packet
+// send internal mqtt logic packet, directly on this connection's own
+// send queue so it can never be stolen by another connection's
+// handleSend
 func (c *connImpl) send(pkt Packet) {
-	c.parent.sendC <- pkt
+	select {
+	case c.sendC <- pkt:
+	case <-c.ctx.Done():
+	}
 }
 
 // wait for connection lost or close
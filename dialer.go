@@ -0,0 +1,131 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// Dialer opens a transport connection to an MQTT server address (the
+// part of a WithServer entry after any scheme prefix). Install a
+// custom one with WithDialer to bypass the scheme-based selection
+// WithServer otherwise drives.
+type Dialer interface {
+	Dial(ctx context.Context, addr string) (net.Conn, error)
+}
+
+// WithDialer overrides the dialer used for every server, bypassing the
+// scheme-based auto-selection (tcp://, tls://, ws://, wss://, unix://)
+// WithServer otherwise applies.
+func WithDialer(d Dialer) Option {
+	return func(c *client) {
+		c.options.dialer = d
+	}
+}
+
+// tcpDialer is the default Dialer, used for the "tcp" and "tls"
+// schemes (and for bare, scheme-less server addresses).
+type tcpDialer struct {
+	timeout   time.Duration
+	tlsConfig *tls.Config
+}
+
+func (d *tcpDialer) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	if d.tlsConfig != nil {
+		return tls.DialWithDialer(&net.Dialer{Timeout: d.timeout}, "tcp", addr, d.tlsConfig)
+	}
+	return (&net.Dialer{Timeout: d.timeout}).DialContext(ctx, "tcp", addr)
+}
+
+// unixDialer dials a unix domain socket, used for the "unix" scheme.
+type unixDialer struct {
+	timeout time.Duration
+}
+
+func (d *unixDialer) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	return (&net.Dialer{Timeout: d.timeout}).DialContext(ctx, "unix", addr)
+}
+
+// wsDialer dials MQTT-over-WebSocket using the "mqtt" subprotocol, per
+// the MQTT spec, used for the "ws" and "wss" schemes.
+type wsDialer struct {
+	tlsConfig *tls.Config
+}
+
+func (d *wsDialer) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	scheme := "ws"
+	httpClient := http.DefaultClient
+	if d.tlsConfig != nil {
+		scheme = "wss"
+		httpClient = &http.Client{Transport: &http.Transport{TLSClientConfig: d.tlsConfig}}
+	}
+
+	wsConn, _, err := websocket.Dial(ctx, scheme+"://"+addr, &websocket.DialOptions{
+		HTTPClient:   httpClient,
+		Subprotocols: []string{"mqtt"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return websocket.NetConn(ctx, wsConn, websocket.MessageBinary), nil
+}
+
+// splitScheme parses a WithServer entry, returning its scheme ("tcp"
+// if unspecified) and the address with any scheme prefix stripped.
+func splitScheme(server string) (scheme, addr string) {
+	if i := strings.Index(server, "://"); i >= 0 {
+		return server[:i], server[i+len("://"):]
+	}
+	return "tcp", server
+}
+
+// resolveDialer picks the Dialer and bare address for server: the
+// client-wide override from WithDialer if set, else one selected from
+// server's scheme prefix.
+func (c *client) resolveDialer(server string) (Dialer, string, error) {
+	scheme, addr := splitScheme(server)
+	if c.options.dialer != nil {
+		return c.options.dialer, addr, nil
+	}
+
+	switch scheme {
+	case "tcp":
+		// a bare or explicit "tcp://" address was the only address form
+		// before WithServer grew scheme support; keep honoring WithTLS
+		// for it so existing callers don't silently downgrade to plaintext
+		return &tcpDialer{timeout: c.options.dialTimeout, tlsConfig: c.options.tlsConfig}, addr, nil
+	case "tls":
+		return &tcpDialer{timeout: c.options.dialTimeout, tlsConfig: c.options.tlsConfig}, addr, nil
+	case "unix":
+		return &unixDialer{timeout: c.options.dialTimeout}, addr, nil
+	case "ws":
+		return &wsDialer{}, addr, nil
+	case "wss":
+		return &wsDialer{tlsConfig: c.options.tlsConfig}, addr, nil
+	default:
+		return nil, "", fmt.Errorf("libmqtt: unknown server scheme %q", scheme)
+	}
+}
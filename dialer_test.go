@@ -0,0 +1,140 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+func TestSplitScheme(t *testing.T) {
+	cases := []struct {
+		server     string
+		wantScheme string
+		wantAddr   string
+	}{
+		{"localhost:1883", "tcp", "localhost:1883"},
+		{"tcp://localhost:1883", "tcp", "localhost:1883"},
+		{"tls://localhost:8883", "tls", "localhost:8883"},
+		{"ws://localhost:8080/mqtt", "ws", "localhost:8080/mqtt"},
+		{"wss://localhost:8443/mqtt", "wss", "localhost:8443/mqtt"},
+		{"unix:///var/run/mqtt.sock", "unix", "/var/run/mqtt.sock"},
+	}
+
+	for _, c := range cases {
+		scheme, addr := splitScheme(c.server)
+		if scheme != c.wantScheme || addr != c.wantAddr {
+			t.Errorf("splitScheme(%q) = (%q, %q), want (%q, %q)",
+				c.server, scheme, addr, c.wantScheme, c.wantAddr)
+		}
+	}
+}
+
+func TestResolveDialerByScheme(t *testing.T) {
+	c := defaultClient()
+
+	cases := []struct {
+		server     string
+		wantDialer interface{}
+		wantAddr   string
+		wantErr    bool
+	}{
+		{"localhost:1883", &tcpDialer{}, "localhost:1883", false},
+		{"tcp://localhost:1883", &tcpDialer{}, "localhost:1883", false},
+		{"tls://localhost:8883", &tcpDialer{}, "localhost:8883", false},
+		{"unix:///var/run/mqtt.sock", &unixDialer{}, "/var/run/mqtt.sock", false},
+		{"ws://localhost:8080", &wsDialer{}, "localhost:8080", false},
+		{"wss://localhost:8443", &wsDialer{}, "localhost:8443", false},
+		{"bogus://localhost:1", nil, "", true},
+	}
+
+	for _, tc := range cases {
+		d, addr, err := c.resolveDialer(tc.server)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("resolveDialer(%q) = nil error, want one", tc.server)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("resolveDialer(%q) failed, err = %v", tc.server, err)
+			continue
+		}
+		if addr != tc.wantAddr {
+			t.Errorf("resolveDialer(%q) addr = %q, want %q", tc.server, addr, tc.wantAddr)
+		}
+
+		switch tc.wantDialer.(type) {
+		case *tcpDialer:
+			if _, ok := d.(*tcpDialer); !ok {
+				t.Errorf("resolveDialer(%q) dialer = %T, want *tcpDialer", tc.server, d)
+			}
+		case *unixDialer:
+			if _, ok := d.(*unixDialer); !ok {
+				t.Errorf("resolveDialer(%q) dialer = %T, want *unixDialer", tc.server, d)
+			}
+		case *wsDialer:
+			if _, ok := d.(*wsDialer); !ok {
+				t.Errorf("resolveDialer(%q) dialer = %T, want *wsDialer", tc.server, d)
+			}
+		}
+	}
+}
+
+func TestResolveDialerHonorsTLSForBareAndTCPScheme(t *testing.T) {
+	c := defaultClient()
+	c.options.tlsConfig = &tls.Config{ServerName: "example.com"}
+
+	for _, server := range []string{"localhost:8883", "tcp://localhost:8883"} {
+		d, _, err := c.resolveDialer(server)
+		if err != nil {
+			t.Fatalf("resolveDialer(%q) failed, err = %v", server, err)
+		}
+		tcp, ok := d.(*tcpDialer)
+		if !ok {
+			t.Fatalf("resolveDialer(%q) dialer = %T, want *tcpDialer", server, d)
+		}
+		if tcp.tlsConfig != c.options.tlsConfig {
+			t.Errorf("resolveDialer(%q) tlsConfig = %v, want the client's WithTLS config", server, tcp.tlsConfig)
+		}
+	}
+}
+
+// customDialer is a test-only Dialer used to verify WithDialer bypasses
+// scheme-based selection entirely.
+type customDialer struct{}
+
+func (customDialer) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	return nil, nil
+}
+
+func TestResolveDialerCustomOverridesScheme(t *testing.T) {
+	c := defaultClient()
+	WithDialer(customDialer{})(c)
+
+	for _, server := range []string{"localhost:1883", "ws://localhost:8080", "unix:///tmp/x.sock"} {
+		d, _, err := c.resolveDialer(server)
+		if err != nil {
+			t.Fatalf("resolveDialer(%q) failed, err = %v", server, err)
+		}
+		if _, ok := d.(customDialer); !ok {
+			t.Errorf("resolveDialer(%q) dialer = %T, want the installed customDialer regardless of scheme", server, d)
+		}
+	}
+}
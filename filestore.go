@@ -0,0 +1,261 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileLogOp identifies the kind of record appended to a fileStore log.
+type fileLogOp byte
+
+const (
+	opPut fileLogOp = iota + 1
+	opDelete
+	opRelease
+)
+
+// fileLogRecord is the on-disk, gob-encoded representation of a single
+// fileStore mutation.
+type fileLogRecord struct {
+	Op        fileLogOp
+	PacketId  uint16
+	Qos       byte
+	IsRetain  bool
+	TopicName string
+	Payload   []byte
+}
+
+// compactThreshold is the number of appended records after which
+// fileStore rewrites its log to only the records needed to rebuild
+// current state, bounding log growth.
+const compactThreshold = 200
+
+// fileStore is a Store backed by a per-ClientID append-only log file
+// under dir, so in-flight QoS1/2 publishes and inbound QoS2 release
+// state survive a process restart. It only supports persisting
+// *PublishPacket, which is all PutOutbound is ever called with.
+type fileStore struct {
+	mu       sync.Mutex
+	path     string
+	log      *os.File
+	writes   int
+	outbound map[uint16]*PublishPacket
+	released map[uint16]struct{}
+}
+
+// NewFileStore opens (creating if necessary) a log file for clientId
+// under dir and replays it to rebuild any previously persisted state.
+func NewFileStore(dir, clientId string) (Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	fs := &fileStore{
+		path:     filepath.Join(dir, clientId+".log"),
+		outbound: make(map[uint16]*PublishPacket),
+		released: make(map[uint16]struct{}),
+	}
+
+	if err := fs.replay(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(fs.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fs.log = f
+	return fs, nil
+}
+
+// replay rebuilds fs.outbound and fs.released from the existing log
+// file, if any.
+func (fs *fileStore) replay() error {
+	f, err := os.Open(fs.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// every record is written by its own gob.Encoder (see append and
+	// compact) and so carries its own type definition, which a single
+	// Decoder would reject as a duplicate; decode each with a fresh
+	// Decoder over a shared bufio.Reader, which no Decoder reads past
+	r := bufio.NewReader(f)
+	for {
+		var rec fileLogRecord
+		if err := gob.NewDecoder(r).Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		switch rec.Op {
+		case opPut:
+			fs.outbound[rec.PacketId] = &PublishPacket{
+				PacketId:  rec.PacketId,
+				Qos:       rec.Qos,
+				IsRetain:  rec.IsRetain,
+				TopicName: rec.TopicName,
+				Payload:   rec.Payload,
+			}
+		case opDelete:
+			delete(fs.outbound, rec.PacketId)
+		case opRelease:
+			fs.released[rec.PacketId] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// append writes rec to the log, compacting first if the log has grown
+// past compactThreshold records since the last compaction.
+func (fs *fileStore) append(rec fileLogRecord) error {
+	fs.writes++
+	if fs.writes >= compactThreshold {
+		if err := fs.compact(); err != nil {
+			return err
+		}
+	}
+	return gob.NewEncoder(fs.log).Encode(rec)
+}
+
+// compact rewrites the log to hold only the records needed to
+// reconstruct the current in-memory state.
+func (fs *fileStore) compact() error {
+	tmpPath := fs.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	for id, pkt := range fs.outbound {
+		err := gob.NewEncoder(tmp).Encode(fileLogRecord{
+			Op:        opPut,
+			PacketId:  id,
+			Qos:       pkt.Qos,
+			IsRetain:  pkt.IsRetain,
+			TopicName: pkt.TopicName,
+			Payload:   pkt.Payload,
+		})
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	for id := range fs.released {
+		if err := gob.NewEncoder(tmp).Encode(fileLogRecord{Op: opRelease, PacketId: id}); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := fs.log.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, fs.path); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(fs.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fs.log = f
+	fs.writes = 0
+	return nil
+}
+
+func (fs *fileStore) PutOutbound(id uint16, pkt Packet) error {
+	pp, ok := pkt.(*PublishPacket)
+	if !ok {
+		return fmt.Errorf("libmqtt: fileStore only persists *PublishPacket, got %T", pkt)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.outbound[id] = pp
+	return fs.append(fileLogRecord{
+		Op:        opPut,
+		PacketId:  id,
+		Qos:       pp.Qos,
+		IsRetain:  pp.IsRetain,
+		TopicName: pp.TopicName,
+		Payload:   pp.Payload,
+	})
+}
+
+func (fs *fileStore) GetOutbound(id uint16) (Packet, bool, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	pkt, ok := fs.outbound[id]
+	return pkt, ok, nil
+}
+
+func (fs *fileStore) DeleteOutbound(id uint16) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.outbound[id]; !ok {
+		return nil
+	}
+	delete(fs.outbound, id)
+	return fs.append(fileLogRecord{Op: opDelete, PacketId: id})
+}
+
+func (fs *fileStore) AllOutbound() ([]Packet, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	pkts := make([]Packet, 0, len(fs.outbound))
+	for _, pkt := range fs.outbound {
+		pkts = append(pkts, pkt)
+	}
+	return pkts, nil
+}
+
+func (fs *fileStore) PutInboundRelease(id uint16) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.released[id] = struct{}{}
+	return fs.append(fileLogRecord{Op: opRelease, PacketId: id})
+}
+
+func (fs *fileStore) Reset() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.outbound = make(map[uint16]*PublishPacket)
+	fs.released = make(map[uint16]struct{})
+	fs.writes = 0
+	return fs.log.Truncate(0)
+}
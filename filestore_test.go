@@ -0,0 +1,162 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"testing"
+)
+
+func TestFileStorePutGetDeleteOutbound(t *testing.T) {
+	fs, err := NewFileStore(t.TempDir(), "client-a")
+	if err != nil {
+		t.Fatalf("NewFileStore failed, err = %v", err)
+	}
+
+	pkt := &PublishPacket{PacketId: 1, Qos: Qos1, TopicName: "foo", Payload: []byte("bar")}
+	if err := fs.PutOutbound(1, pkt); err != nil {
+		t.Fatalf("PutOutbound failed, err = %v", err)
+	}
+
+	got, ok, err := fs.GetOutbound(1)
+	if err != nil || !ok {
+		t.Fatalf("GetOutbound(1) = %v, %v, %v, want a hit", got, ok, err)
+	}
+	if got.(*PublishPacket).TopicName != "foo" {
+		t.Fatalf("GetOutbound(1).TopicName = %q, want %q", got.(*PublishPacket).TopicName, "foo")
+	}
+
+	if err := fs.DeleteOutbound(1); err != nil {
+		t.Fatalf("DeleteOutbound failed, err = %v", err)
+	}
+	if _, ok, _ := fs.GetOutbound(1); ok {
+		t.Fatalf("GetOutbound(1) after delete = ok, want a miss")
+	}
+}
+
+func TestFileStorePutOutboundRejectsNonPublish(t *testing.T) {
+	fs, err := NewFileStore(t.TempDir(), "client-a")
+	if err != nil {
+		t.Fatalf("NewFileStore failed, err = %v", err)
+	}
+
+	if err := fs.PutOutbound(1, PingReqPacket); err == nil {
+		t.Fatalf("PutOutbound with a non-*PublishPacket, want an error")
+	}
+}
+
+func TestFileStoreSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	fs, err := NewFileStore(dir, "client-a")
+	if err != nil {
+		t.Fatalf("NewFileStore failed, err = %v", err)
+	}
+	if err := fs.PutOutbound(1, &PublishPacket{PacketId: 1, Qos: Qos2, TopicName: "foo", Payload: []byte("bar")}); err != nil {
+		t.Fatalf("PutOutbound(1) failed, err = %v", err)
+	}
+	if err := fs.PutOutbound(2, &PublishPacket{PacketId: 2, Qos: Qos1, TopicName: "baz", Payload: []byte("qux")}); err != nil {
+		t.Fatalf("PutOutbound(2) failed, err = %v", err)
+	}
+	if err := fs.DeleteOutbound(2); err != nil {
+		t.Fatalf("DeleteOutbound(2) failed, err = %v", err)
+	}
+	if err := fs.PutInboundRelease(3); err != nil {
+		t.Fatalf("PutInboundRelease(3) failed, err = %v", err)
+	}
+
+	// reopen against the same directory, simulating a process restart
+	reopened, err := NewFileStore(dir, "client-a")
+	if err != nil {
+		t.Fatalf("NewFileStore (reopen) failed, err = %v", err)
+	}
+
+	all, err := reopened.AllOutbound()
+	if err != nil {
+		t.Fatalf("AllOutbound failed, err = %v", err)
+	}
+	if len(all) != 1 || all[0].(*PublishPacket).PacketId != 1 {
+		t.Fatalf("AllOutbound after reopen = %v, want only packet 1", all)
+	}
+}
+
+func TestFileStoreCompacts(t *testing.T) {
+	dir := t.TempDir()
+
+	fs, err := NewFileStore(dir, "client-a")
+	if err != nil {
+		t.Fatalf("NewFileStore failed, err = %v", err)
+	}
+
+	// put and immediately delete the same id past compactThreshold times;
+	// nothing should survive a restart once the log has been compacted
+	for i := 0; i < compactThreshold+10; i++ {
+		id := uint16(i%64 + 1)
+		if err := fs.PutOutbound(id, &PublishPacket{PacketId: id, Qos: Qos1, TopicName: "t", Payload: []byte("p")}); err != nil {
+			t.Fatalf("PutOutbound(%d) failed, err = %v", id, err)
+		}
+		if err := fs.DeleteOutbound(id); err != nil {
+			t.Fatalf("DeleteOutbound(%d) failed, err = %v", id, err)
+		}
+	}
+
+	reopened, err := NewFileStore(dir, "client-a")
+	if err != nil {
+		t.Fatalf("NewFileStore (reopen) failed, err = %v", err)
+	}
+	all, err := reopened.AllOutbound()
+	if err != nil {
+		t.Fatalf("AllOutbound failed, err = %v", err)
+	}
+	if len(all) != 0 {
+		t.Fatalf("AllOutbound after reopen = %v, want none left outstanding", all)
+	}
+}
+
+func TestFileStoreReset(t *testing.T) {
+	dir := t.TempDir()
+
+	fs, err := NewFileStore(dir, "client-a")
+	if err != nil {
+		t.Fatalf("NewFileStore failed, err = %v", err)
+	}
+	if err := fs.PutOutbound(1, &PublishPacket{PacketId: 1, Qos: Qos1, TopicName: "foo", Payload: []byte("bar")}); err != nil {
+		t.Fatalf("PutOutbound failed, err = %v", err)
+	}
+	if err := fs.Reset(); err != nil {
+		t.Fatalf("Reset failed, err = %v", err)
+	}
+
+	all, err := fs.AllOutbound()
+	if err != nil {
+		t.Fatalf("AllOutbound failed, err = %v", err)
+	}
+	if len(all) != 0 {
+		t.Fatalf("AllOutbound after Reset = %v, want none", all)
+	}
+
+	reopened, err := NewFileStore(dir, "client-a")
+	if err != nil {
+		t.Fatalf("NewFileStore (reopen) failed, err = %v", err)
+	}
+	all, err = reopened.AllOutbound()
+	if err != nil {
+		t.Fatalf("AllOutbound failed, err = %v", err)
+	}
+	if len(all) != 0 {
+		t.Fatalf("AllOutbound after Reset survives restart = %v, want none", all)
+	}
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import "sync"
+
+// Store persists in-flight QoS1/2 publishes and inbound QoS2 release
+// state, so a crash or restart between Publish and the matching ack
+// does not silently drop a message. NewClient defaults to an in-memory
+// Store (memStore); use WithStore to install a durable one such as
+// NewFileStore.
+type Store interface {
+	// PutOutbound persists pkt (always a *PublishPacket) as awaiting
+	// ack under id.
+	PutOutbound(id uint16, pkt Packet) error
+
+	// GetOutbound retrieves the packet previously persisted under id,
+	// ok is false if nothing is stored for id.
+	GetOutbound(id uint16) (pkt Packet, ok bool, err error)
+
+	// DeleteOutbound drops the packet persisted under id, once it has
+	// been fully acknowledged.
+	DeleteOutbound(id uint16) error
+
+	// AllOutbound returns every outbound packet currently persisted,
+	// in no particular order. Used to resend with DUP=1 on (re)connect.
+	AllOutbound() ([]Packet, error)
+
+	// PutInboundRelease records that a PUBREL has been received for
+	// inbound QoS2 id, so a crash before PUBCOMP is sent can be
+	// recognized and retried by an upper layer.
+	PutInboundRelease(id uint16) error
+
+	// Reset clears all persisted state. The client never calls it
+	// itself, not even when connecting with a clean session.
+	Reset() error
+}
+
+// WithStore installs s as the Store used to persist in-flight QoS1/2
+// publishes and inbound QoS2 release state. Defaults to an in-memory
+// Store that does not survive process restarts.
+func WithStore(s Store) Option {
+	return func(c *client) {
+		if s != nil {
+			c.options.store = s
+		}
+	}
+}
+
+// memStore is the default Store, preserving the prior in-process-only
+// behavior.
+type memStore struct {
+	outbound *sync.Map // packetId -> Packet
+	released *sync.Map // packetId -> struct{}
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		outbound: &sync.Map{},
+		released: &sync.Map{},
+	}
+}
+
+func (m *memStore) PutOutbound(id uint16, pkt Packet) error {
+	m.outbound.Store(id, pkt)
+	return nil
+}
+
+func (m *memStore) GetOutbound(id uint16) (Packet, bool, error) {
+	v, ok := m.outbound.Load(id)
+	if !ok {
+		return nil, false, nil
+	}
+	return v.(Packet), true, nil
+}
+
+func (m *memStore) DeleteOutbound(id uint16) error {
+	m.outbound.Delete(id)
+	return nil
+}
+
+func (m *memStore) AllOutbound() ([]Packet, error) {
+	pkts := make([]Packet, 0)
+	m.outbound.Range(func(k, v interface{}) bool {
+		pkts = append(pkts, v.(Packet))
+		return true
+	})
+	return pkts, nil
+}
+
+func (m *memStore) PutInboundRelease(id uint16) error {
+	m.released.Store(id, struct{}{})
+	return nil
+}
+
+func (m *memStore) Reset() error {
+	m.outbound = &sync.Map{}
+	m.released = &sync.Map{}
+	return nil
+}
@@ -0,0 +1,249 @@
+/*
+ * Copyright GoIIoT (https://github.com/goiiot)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package libmqtt
+
+import (
+	"fmt"
+	"time"
+)
+
+// ProtocolVersion identifies which MQTT protocol revision a client speaks.
+type ProtocolVersion byte
+
+const (
+	// V311 is MQTT 3.1.1, the default and the only version understood
+	// by a client created without WithProtocolVersion.
+	V311 ProtocolVersion = iota
+
+	// V5 is MQTT 5.0.
+	V5
+)
+
+// DisconnHandler is called whenever the broker closes the connection
+// with a DISCONNECT packet, most notably with ReasonSessionTakenOver
+// when another client connects with the same ClientID.
+type DisconnHandler func(server string, reasonCode byte, props *Properties)
+
+// AssignedIdHandler is called once, right after CONNACK, when the
+// broker assigns a ClientID because none was requested in CONNECT.
+type AssignedIdHandler func(server string, assignedClientId string)
+
+// MQTT v5 DISCONNECT reason codes this client understands.
+const (
+	ReasonNormalDisconnection byte = 0x00
+	ReasonSessionTakenOver    byte = 0x8E
+)
+
+// Properties carries the subset of MQTT v5 CONNECT/CONNACK/DISCONNECT
+// properties this client understands.
+type Properties struct {
+	SessionExpiryInterval      uint32
+	ReceiveMaximum             uint16
+	MaximumPacketSize          uint32
+	TopicAliasMaximum          uint16
+	RequestResponseInformation bool
+	AuthenticationMethod       string
+	AuthenticationData         []byte
+	UserProperties             map[string]string
+}
+
+// ConPacketV5 is the MQTT v5 variant of ConPacket, carrying the
+// connect-time Properties alongside the v3.1.1 fields.
+type ConPacketV5 struct {
+	ConPacket
+
+	Properties     *Properties
+	WillDelay      time.Duration
+	WillProperties *Properties
+}
+
+// ConAckPacketV5 is the MQTT v5 variant of ConAckPacket, exposing the
+// broker-assigned ClientID and connection-scoped Properties.
+type ConAckPacketV5 struct {
+	ConAckPacket
+
+	AssignedClientId string
+	Properties       *Properties
+}
+
+// DisconnectPacketV5 carries a DISCONNECT reason code and properties,
+// used both to send a graceful disconnect and to decode a broker-sent
+// DISCONNECT (e.g. ReasonSessionTakenOver).
+type DisconnectPacketV5 struct {
+	ReasonCode byte
+	Properties *Properties
+}
+
+// ReasonError wraps a non-zero MQTT v5 reason code as a Go error, so it
+// can be passed through the existing ack handler callbacks.
+type ReasonError struct {
+	Code byte
+}
+
+func (e *ReasonError) Error() string {
+	return fmt.Sprintf("libmqtt: reason code 0x%02X", e.Code)
+}
+
+// reasonErr turns an ack reason code into an error, nil for success
+// codes (anything below 0x80, per the v5 spec).
+func reasonErr(code byte) error {
+	if code < 0x80 {
+		return nil
+	}
+	return &ReasonError{Code: code}
+}
+
+// WithProtocolVersion selects which MQTT protocol revision to speak.
+// Defaults to V311.
+func WithProtocolVersion(v ProtocolVersion) Option {
+	return func(c *client) {
+		c.options.protocolVersion = v
+	}
+}
+
+// WithSessionExpiry sets the v5 CONNECT SessionExpiryInterval property,
+// requesting the broker retain session state for d after disconnect.
+// Only meaningful with WithProtocolVersion(V5).
+func WithSessionExpiry(d time.Duration) Option {
+	return func(c *client) {
+		c.options.sessionExpiry = d
+	}
+}
+
+// WithReceiveMaximum sets the v5 CONNECT ReceiveMaximum property,
+// capping the number of QoS1/2 publishes the broker may have
+// in-flight towards this client at once.
+func WithReceiveMaximum(n uint16) Option {
+	return func(c *client) {
+		c.options.receiveMaximum = n
+	}
+}
+
+// WithTopicAliasMaximum sets the v5 CONNECT TopicAliasMaximum property
+// and enables outgoing topic alias compression for publishes, mapping
+// up to n topic names to numeric aliases per connection.
+func WithTopicAliasMaximum(n uint16) Option {
+	return func(c *client) {
+		c.options.topicAliasMax = n
+	}
+}
+
+// WithWillDelay sets the v5 CONNECT will delay, the time the broker
+// should wait after an ungraceful disconnect before publishing the
+// will message.
+func WithWillDelay(d time.Duration) Option {
+	return func(c *client) {
+		c.options.willDelay = d
+	}
+}
+
+// WithDisconnHandler sets the handler called when the broker closes
+// the connection with a DISCONNECT packet (v5 only).
+func WithDisconnHandler(h DisconnHandler) Option {
+	return func(c *client) {
+		c.options.disconnHandler = h
+	}
+}
+
+// WithAssignedIdHandler sets the handler called once the broker
+// assigns a ClientID in CONNACK (v5 only, and only when no ClientID
+// was set via WithClientId).
+func WithAssignedIdHandler(h AssignedIdHandler) Option {
+	return func(c *client) {
+		c.options.assignedIdHandler = h
+	}
+}
+
+// connPacketV5 builds the v5 CONNECT packet for this client's options.
+func (c *client) connPacketV5() *ConPacketV5 {
+	return &ConPacketV5{
+		ConPacket: ConPacket{
+			Username:     c.options.username,
+			Password:     c.options.password,
+			ClientId:     c.options.clientId,
+			CleanSession: c.options.cleanSession,
+			IsWill:       c.options.isWill,
+			WillQos:      c.options.willQos,
+			WillTopic:    c.options.willTopic,
+			WillMessage:  c.options.willPayload,
+			WillRetain:   c.options.willRetain,
+			Keepalive:    uint16(c.options.keepalive / time.Second),
+		},
+		Properties: &Properties{
+			SessionExpiryInterval: uint32(c.options.sessionExpiry / time.Second),
+			ReceiveMaximum:        c.options.receiveMaximum,
+			TopicAliasMaximum:     c.options.topicAliasMax,
+		},
+		WillDelay: c.options.willDelay,
+	}
+}
+
+// topicAlias maps topic names to numeric aliases for a single
+// connection, so repeat publishes to the same topic can omit the topic
+// name after its first use (v5 only). Outgoing aliases are assigned
+// here by applyOutbound; incoming ones are learned from the broker's
+// publishes by resolveInbound.
+type topicAlias struct {
+	max  uint16
+	next uint16
+	out  map[string]uint16 // topic name -> alias, for outgoing publishes
+	in   map[uint16]string // alias -> topic name, for incoming publishes
+}
+
+func newTopicAlias(max uint16) *topicAlias {
+	return &topicAlias{
+		max: max,
+		out: make(map[string]uint16),
+		in:  make(map[uint16]string),
+	}
+}
+
+// applyOutbound rewrites pkt to use a topic alias when one is already
+// established, or establishes a new one (leaving TopicName set, as
+// required on first use) when there is room for it.
+func (a *topicAlias) applyOutbound(pkt *PublishPacket) {
+	if a == nil || a.max == 0 {
+		return
+	}
+
+	if alias, ok := a.out[pkt.TopicName]; ok {
+		pkt.TopicAlias = alias
+		pkt.TopicName = ""
+		return
+	}
+
+	if a.next < a.max {
+		a.next++
+		a.out[pkt.TopicName] = a.next
+		pkt.TopicAlias = a.next
+	}
+}
+
+// resolveInbound fills in TopicName from a previously-seen alias, or
+// (on first use of that alias) records the mapping for next time.
+func (a *topicAlias) resolveInbound(pkt *PublishPacket) {
+	if a == nil || pkt.TopicAlias == 0 {
+		return
+	}
+
+	if pkt.TopicName == "" {
+		pkt.TopicName = a.in[pkt.TopicAlias]
+		return
+	}
+
+	a.in[pkt.TopicAlias] = pkt.TopicName
+}